@@ -0,0 +1,65 @@
+package desync
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrCopyRangeUnsupported is returned by a CopyRangeMethod when it can't
+// handle the given combination of file descriptors, alignment or
+// filesystem. The caller should fall through to the next method in its
+// chain rather than treat it as a hard failure.
+var ErrCopyRangeUnsupported = errors.New("copy-range method unsupported for this operation")
+
+// CopyRangeMethod copies, or reflinks, a range of bytes from one file into
+// another. Implementations probe the capability of the given files on
+// every call instead of relying on a one-time feature check, since some
+// filesystems (overlayfs in particular) report reflink support that
+// doesn't actually hold for every pair of files.
+type CopyRangeMethod interface {
+	// Name identifies the method, mainly for logging and configuration.
+	Name() string
+
+	// CopyRange copies length bytes from src at srcOffset into dst at
+	// dstOffset. blocksize is the filesystem block size, used by methods
+	// that need an aligned range to reflink; methods that don't need
+	// alignment ignore it. Returns ErrCopyRangeUnsupported if this method
+	// can't perform the copy for the given files, so the caller can try
+	// the next one in its chain.
+	CopyRange(dst, src *os.File, srcOffset, length, dstOffset, blocksize uint64) error
+}
+
+// DefaultCopyRangeMethods is the fallback chain FileSeed uses unless a
+// seed is given WithCopyRangeMethods. Methods are tried in order from
+// most-efficient to universally-supported, each falling through to the
+// next on ErrCopyRangeUnsupported.
+var DefaultCopyRangeMethods = []CopyRangeMethod{
+	Ficlone,
+	CopyFileRange,
+	Sendfile,
+	Mmap,
+	IOCopy,
+}
+
+// ioCopyMethod is the universal fallback, a plain userspace copy via
+// io.CopyN. It never returns ErrCopyRangeUnsupported, so it's always safe
+// to put at the end of a chain.
+type ioCopyMethod struct{}
+
+// IOCopy is a plain io.CopyN copy, supported on every platform and
+// filesystem pairing.
+var IOCopy CopyRangeMethod = ioCopyMethod{}
+
+func (ioCopyMethod) Name() string { return "io.CopyN" }
+
+func (ioCopyMethod) CopyRange(dst, src *os.File, srcOffset, length, dstOffset, blocksize uint64) error {
+	if _, err := dst.Seek(int64(dstOffset), os.SEEK_SET); err != nil {
+		return err
+	}
+	if _, err := src.Seek(int64(srcOffset), os.SEEK_SET); err != nil {
+		return err
+	}
+	_, err := io.CopyN(dst, src, int64(length))
+	return err
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package desync
+
+import "os"
+
+// unsupportedCopyRangeMethod backs the Linux-only methods on platforms that
+// don't have them, so DefaultCopyRangeMethods can fall straight through to
+// IOCopy without a platform-specific chain.
+type unsupportedCopyRangeMethod struct{ name string }
+
+func (u unsupportedCopyRangeMethod) Name() string { return u.name }
+
+func (u unsupportedCopyRangeMethod) CopyRange(dst, src *os.File, srcOffset, length, dstOffset, blocksize uint64) error {
+	return ErrCopyRangeUnsupported
+}
+
+var (
+	// Ficlone is Linux-only (FICLONERANGE); always unsupported here.
+	Ficlone CopyRangeMethod = unsupportedCopyRangeMethod{"ficlone"}
+	// CopyFileRange is Linux-only (copy_file_range(2)); always unsupported here.
+	CopyFileRange CopyRangeMethod = unsupportedCopyRangeMethod{"copy_file_range"}
+	// Sendfile is Linux-only for file-to-file copies; always unsupported here.
+	Sendfile CopyRangeMethod = unsupportedCopyRangeMethod{"sendfile"}
+	// Mmap is disabled on platforms without the Linux-specific fd handling used here.
+	Mmap CopyRangeMethod = unsupportedCopyRangeMethod{"mmap"}
+)
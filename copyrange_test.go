@@ -0,0 +1,131 @@
+package desync
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestIOCopyMethodCopiesRange(t *testing.T) {
+	src, err := os.CreateTemp("", "desync-iocopy-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	if _, err := src.WriteString("0123456789"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := os.CreateTemp("", "desync-iocopy-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+
+	if err := IOCopy.CopyRange(dst, src, 2, 5, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 5)
+	if _, err := dst.ReadAt(got, 1); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "23456" {
+		t.Fatalf("expected \"23456\", got %q", got)
+	}
+}
+
+// fakeCopyRangeMethod lets tests control exactly which methods in a chain
+// succeed, fail outright, or report themselves unsupported.
+type fakeCopyRangeMethod struct {
+	name   string
+	err    error
+	called *bool
+}
+
+func (f fakeCopyRangeMethod) Name() string { return f.name }
+
+func (f fakeCopyRangeMethod) CopyRange(dst, src *os.File, srcOffset, length, dstOffset, blocksize uint64) error {
+	if f.called != nil {
+		*f.called = true
+	}
+	return f.err
+}
+
+func TestFileSeedSegmentCopyRangeFallsThroughChain(t *testing.T) {
+	src, err := os.CreateTemp("", "desync-chain-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	dst, err := os.CreateTemp("", "desync-chain-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+
+	var firstCalled, secondCalled bool
+	seg := &fileSeedSegment{
+		copyMethods: []CopyRangeMethod{
+			fakeCopyRangeMethod{name: "unsupported", err: ErrCopyRangeUnsupported, called: &firstCalled},
+			fakeCopyRangeMethod{name: "succeeds", err: nil, called: &secondCalled},
+		},
+	}
+	if err := seg.copyRange(dst, src, 0, 0, 0, 0); err != nil {
+		t.Fatalf("expected the chain to fall through to the working method, got: %s", err)
+	}
+	if !firstCalled || !secondCalled {
+		t.Fatalf("expected both methods to be tried, got first=%v second=%v", firstCalled, secondCalled)
+	}
+}
+
+func TestFileSeedSegmentCopyRangeStopsOnRealError(t *testing.T) {
+	src, err := os.CreateTemp("", "desync-chain-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	dst, err := os.CreateTemp("", "desync-chain-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+
+	wantErr := errors.New("disk on fire")
+	var secondCalled bool
+	seg := &fileSeedSegment{
+		copyMethods: []CopyRangeMethod{
+			fakeCopyRangeMethod{name: "broken", err: wantErr},
+			fakeCopyRangeMethod{name: "never-reached", called: &secondCalled},
+		},
+	}
+	if err := seg.copyRange(dst, src, 0, 0, 0, 0); !errors.Is(err, wantErr) {
+		t.Fatalf("expected the real error to propagate, got: %v", err)
+	}
+	if secondCalled {
+		t.Fatal("expected the chain to stop at the first non-ErrCopyRangeUnsupported error")
+	}
+}
+
+func TestFileSeedSegmentCopyRangeAllUnsupported(t *testing.T) {
+	src, err := os.CreateTemp("", "desync-chain-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	dst, err := os.CreateTemp("", "desync-chain-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+
+	seg := &fileSeedSegment{
+		copyMethods: []CopyRangeMethod{
+			fakeCopyRangeMethod{name: "a", err: ErrCopyRangeUnsupported},
+			fakeCopyRangeMethod{name: "b", err: ErrCopyRangeUnsupported},
+		},
+	}
+	if err := seg.copyRange(dst, src, 0, 0, 0, 0); !errors.Is(err, ErrCopyRangeUnsupported) {
+		t.Fatalf("expected ErrCopyRangeUnsupported when every method declines, got: %v", err)
+	}
+}
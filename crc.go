@@ -0,0 +1,125 @@
+package desync
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// crc32cTable is the Castagnoli CRC32 polynomial table. The standard
+// library's crc32 package uses the SSE 4.2/ARM64 CRC32 instructions for it
+// automatically when the CPU supports them, so checksumming with it is
+// effectively free compared to a SHA-512/256 re-hash.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crcSidecarRecord is one fixed-size entry in a seed's CRC32C sidecar
+// file. The fixed, 8-byte-aligned layout (offset, length, crc32, padding)
+// means the whole sidecar can be mmaped and binary-searched by offset
+// without having to parse it first, the same way Prometheus TSDB segment
+// indexes are laid out.
+type crcSidecarRecord struct {
+	Offset uint64
+	Length uint64
+	CRC    uint32
+	_      uint32 // padding, keeps the record 8-byte aligned
+}
+
+const crcSidecarRecordSize = 24
+
+// crcSidecarPath returns the path of the CRC32C sidecar for a seed file. It
+// sits right next to the seed data so it travels with it.
+func crcSidecarPath(srcFile string) string {
+	return srcFile + ".crc"
+}
+
+// WriteCRCSidecar computes a CRC32C for every chunk in chunks and writes
+// them to srcFile's sidecar, so a later FileSeed opened with
+// WithVerifyMode(VerifyCRC) can validate cheaply instead of re-hashing
+// every chunk with SHA-512/256.
+func WriteCRCSidecar(srcFile string, chunks []IndexChunk) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := os.Create(crcSidecarPath(srcFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, crcSidecarRecordSize)
+	for _, c := range chunks {
+		b := make([]byte, c.Size)
+		if _, err := src.ReadAt(b, int64(c.Start)); err != nil {
+			return fmt.Errorf("reading chunk at %d from %s: %s", c.Start, srcFile, err)
+		}
+		binary.LittleEndian.PutUint64(buf[0:8], c.Start)
+		binary.LittleEndian.PutUint64(buf[8:16], c.Size)
+		binary.LittleEndian.PutUint32(buf[16:20], crc32.Checksum(b, crc32cTable))
+		binary.LittleEndian.PutUint32(buf[20:24], 0)
+		if _, err := f.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCRCSidecar reads and decodes a seed's CRC32C sidecar file in full.
+// Records come out sorted by Offset, since WriteCRCSidecar writes them in
+// the same order as the chunk table it was given.
+func readCRCSidecar(path string) ([]crcSidecarRecord, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b)%crcSidecarRecordSize != 0 {
+		return nil, fmt.Errorf("%s: truncated CRC sidecar", path)
+	}
+	records := make([]crcSidecarRecord, len(b)/crcSidecarRecordSize)
+	for i := range records {
+		r := b[i*crcSidecarRecordSize:]
+		records[i] = crcSidecarRecord{
+			Offset: binary.LittleEndian.Uint64(r[0:8]),
+			Length: binary.LittleEndian.Uint64(r[8:16]),
+			CRC:    binary.LittleEndian.Uint32(r[16:20]),
+		}
+	}
+	return records, nil
+}
+
+// findCRCRecord binary-searches records, sorted by Offset, for the entry
+// covering the chunk starting at offset.
+func findCRCRecord(records []crcSidecarRecord, offset uint64) (crcSidecarRecord, bool) {
+	i := sort.Search(len(records), func(i int) bool { return records[i].Offset >= offset })
+	if i < len(records) && records[i].Offset == offset {
+		return records[i], true
+	}
+	return crcSidecarRecord{}, false
+}
+
+// VerifySeedFile validates srcFile against idx the way a FileSeed would,
+// according to mode. It lets an operator scrub a seed on demand without
+// running a full extraction, and is meant to back a `desync verify-seed`
+// CLI subcommand.
+//
+// TODO: that subcommand itself (cmd/desync flag parsing and wiring) is a
+// follow-up; this function is only the library-level piece.
+func VerifySeedFile(srcFile string, idx Index, mode VerifyMode) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	s := &fileSeedSegment{
+		file:           srcFile,
+		chunks:         idx.Chunks,
+		verifyMode:     mode,
+		needValidation: true,
+	}
+	return s.validate(src)
+}
@@ -0,0 +1,104 @@
+package desync
+
+import (
+	"crypto/sha512"
+	"os"
+	"testing"
+)
+
+func TestCRCSidecarRoundTrip(t *testing.T) {
+	f, err := os.CreateTemp("", "desync-crc-seed-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(crcSidecarPath(f.Name()))
+
+	data := []byte("hello world, this is some seed data")
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	chunks := []IndexChunk{
+		{ID: chunkID(1), Start: 0, Size: 10},
+		{ID: chunkID(2), Start: 10, Size: uint64(len(data) - 10)},
+	}
+	if err := WriteCRCSidecar(f.Name(), chunks); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := readCRCSidecar(crcSidecarPath(f.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(chunks) {
+		t.Fatalf("expected %d records, got %d", len(chunks), len(records))
+	}
+	rec, ok := findCRCRecord(records, 10)
+	if !ok {
+		t.Fatal("expected a record for the chunk starting at offset 10")
+	}
+	if rec.Length != chunks[1].Size {
+		t.Fatalf("expected length %d, got %d", chunks[1].Size, rec.Length)
+	}
+}
+
+func TestValidateCRCFallsBackToFullOnMismatch(t *testing.T) {
+	f, err := os.CreateTemp("", "desync-crc-fallback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(crcSidecarPath(f.Name()))
+
+	data := []byte("0123456789")
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// The chunk's real ID, computed from the actual data, so the
+	// validateFull fallback succeeds.
+	id := ChunkID(sha512.Sum512_256(data))
+	chunks := []IndexChunk{{ID: id, Start: 0, Size: uint64(len(data))}}
+
+	// Sidecar has no entry at all for this file: validateCRC must fall
+	// back to a full SHA re-hash instead of trusting unverified data.
+	seg := &fileSeedSegment{file: f.Name(), chunks: chunks, verifyMode: VerifyCRC, needValidation: true}
+	src, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	if err := seg.validate(src); err != nil {
+		t.Fatalf("expected validation to succeed via the full-hash fallback, got: %s", err)
+	}
+
+	// Now write a sidecar with a deliberately wrong CRC for that chunk;
+	// validateCRC should again fall back to the full hash, which still
+	// succeeds because the data itself is correct.
+	if err := WriteCRCSidecar(f.Name(), chunks); err != nil {
+		t.Fatal(err)
+	}
+	corruptCRCSidecar(t, crcSidecarPath(f.Name()))
+
+	if err := seg.validate(src); err != nil {
+		t.Fatalf("expected validation to succeed despite a corrupt CRC sidecar, got: %s", err)
+	}
+}
+
+// corruptCRCSidecar flips the CRC field of the sidecar's first record so
+// it no longer matches the chunk's data.
+func corruptCRCSidecar(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 16); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,27 +2,124 @@ package desync
 
 import (
 	"crypto/sha512"
+	"encoding/gob"
+	"errors"
 	"fmt"
-	"io"
+	"hash/crc32"
 	"os"
+	"sort"
+	"sync"
 )
 
 // FileSeed is used to copy or clone blocks from an existing index+blob during
 // file extraction.
 type FileSeed struct {
-	srcFile    string
-	index      Index
-	pos        map[ChunkID][]int
-	canReflink bool
+	srcFile        string
+	index          Index
+	pos            map[ChunkID][]int
+	copyMethods    []CopyRangeMethod
+	preserveSparse bool
+	verifyMode     VerifyMode
+}
+
+// VerifyMode controls how thoroughly a FileSeed checks its chunks against
+// the underlying file data before using them.
+type VerifyMode int
+
+const (
+	// VerifyFull re-hashes every chunk with SHA-512/256 against the seed
+	// index, the way FileSeed has always validated. It's the default.
+	VerifyFull VerifyMode = iota
+	// VerifyCRC checks each chunk against the cheap CRC32C sidecar written
+	// by WriteCRCSidecar. If the sidecar is missing, or any chunk has no
+	// sidecar entry or fails the CRC check, the whole segment is verified
+	// as with VerifyFull instead.
+	VerifyCRC
+	// VerifyNone skips validation entirely and trusts the seed's index.
+	VerifyNone
+)
+
+// FileSeedOption customizes the behavior of a FileSeed. Pass it to
+// NewIndexSeed or NewRawFileSeed.
+type FileSeedOption func(*FileSeed)
+
+// WithCopyRangeMethods overrides the default copy-range fallback chain
+// (DefaultCopyRangeMethods) for this seed. Passing a single method, e.g.
+// WithCopyRangeMethods(Ficlone), disables fallback entirely: extraction
+// fails rather than degrading to a plain copy if that method can't handle
+// a given range.
+func WithCopyRangeMethods(methods ...CopyRangeMethod) FileSeedOption {
+	return func(s *FileSeed) {
+		s.copyMethods = methods
+	}
+}
+
+// WithPreserveSparse makes the seed turn all-zero regions into holes
+// (FALLOC_FL_PUNCH_HOLE) in the destination file instead of physically
+// writing zero bytes, and skip existing holes in the seed file itself via
+// SEEK_HOLE/SEEK_DATA rather than reading and copying them. This can
+// dramatically cut extraction time and on-disk footprint for VM and
+// container images that contain multi-GB zero runs. Where the destination
+// can't have holes punched (any non-Linux platform, or a filesystem without
+// FALLOC_FL_PUNCH_HOLE), the zero bytes are written out instead.
+func WithPreserveSparse(preserve bool) FileSeedOption {
+	return func(s *FileSeed) {
+		s.preserveSparse = preserve
+	}
+}
+
+// WithVerifyMode overrides how thoroughly the seed checks its chunks
+// against the underlying file data before using them. The default is
+// VerifyFull.
+func WithVerifyMode(mode VerifyMode) FileSeedOption {
+	return func(s *FileSeed) {
+		s.verifyMode = mode
+	}
 }
 
 // NewIndexSeed initializes a new seed that uses an existing index and its blob
-func NewIndexSeed(dstFile string, srcFile string, index Index) (*FileSeed, error) {
+func NewIndexSeed(dstFile string, srcFile string, index Index, opts ...FileSeedOption) (*FileSeed, error) {
+	s := FileSeed{
+		srcFile:     srcFile,
+		pos:         make(map[ChunkID][]int),
+		index:       index,
+		copyMethods: DefaultCopyRangeMethods,
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	for i, c := range s.index.Chunks {
+		s.pos[c.ID] = append(s.pos[c.ID], i)
+	}
+	return &s, nil
+}
+
+// NewRawFileSeed initializes a seed from a plain file that has no
+// precomputed index of its own, such as a previous release tarball, a
+// mounted rootfs or a snapshot. It chunks srcFile itself using the same
+// content-defined chunking parameters (min/avg/max size) as dstIdx, the
+// index driving the extraction, so the resulting chunks can land in
+// s.pos and be matched by LongestMatchWith exactly like chunks from a
+// real desync index. This lets a seed be used without first having to
+// casync-index it.
+//
+// The chunk table produced by the scan is cached on disk next to
+// srcFile, keyed by its size and modification time and by the chunking
+// parameters, so repeated invocations against an unmodified file with the
+// same parameters skip the rescan.
+func NewRawFileSeed(dstFile string, srcFile string, dstIdx Index, opts ...FileSeedOption) (*FileSeed, error) {
+	chunks, err := rawFileChunks(srcFile, dstIdx.Index.ChunkSizeMin, dstIdx.Index.ChunkSizeAvg, dstIdx.Index.ChunkSizeMax)
+	if err != nil {
+		return nil, fmt.Errorf("scanning %s for chunk boundaries: %s", srcFile, err)
+	}
 	s := FileSeed{
-		srcFile:    srcFile,
-		pos:        make(map[ChunkID][]int),
-		index:      index,
-		canReflink: CanClone(dstFile, srcFile),
+		srcFile:     srcFile,
+		pos:         make(map[ChunkID][]int),
+		index:       Index{Index: dstIdx.Index, Chunks: chunks},
+		copyMethods: DefaultCopyRangeMethods,
+	}
+	for _, opt := range opts {
+		opt(&s)
 	}
 	for i, c := range s.index.Chunks {
 		s.pos[c.ID] = append(s.pos[c.ID], i)
@@ -30,65 +127,271 @@ func NewIndexSeed(dstFile string, srcFile string, index Index) (*FileSeed, error
 	return &s, nil
 }
 
+// rawFileChunks performs a content-defined chunking pass (the same rolling
+// hash desync uses to build regular indexes) over srcFile and returns the
+// resulting chunk table, using a cached result from a previous call when
+// neither the file nor the chunking parameters have changed.
+func rawFileChunks(srcFile string, min, avg, max uint64) ([]IndexChunk, error) {
+	info, err := os.Stat(srcFile)
+	if err != nil {
+		return nil, err
+	}
+	cache := rawSeedCachePath(srcFile)
+	if chunks, ok := readRawSeedCache(cache, info, min, avg, max); ok {
+		return chunks, nil
+	}
+
+	f, err := os.Open(srcFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := NewChunker(f, min, avg, max)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		chunks []IndexChunk
+		start  uint64
+	)
+	for {
+		_, b, err := c.Next()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			break
+		}
+		chunks = append(chunks, IndexChunk{
+			ID:    sha512.Sum512_256(b),
+			Start: start,
+			Size:  uint64(len(b)),
+		})
+		start += uint64(len(b))
+	}
+
+	writeRawSeedCache(cache, info, min, avg, max, chunks)
+	return chunks, nil
+}
+
+// rawSeedCachePath returns the path of the on-disk chunk-table cache for a
+// raw seed file. It sits next to the seed itself so it travels with it.
+func rawSeedCachePath(srcFile string) string {
+	return srcFile + ".desync-seed-cache"
+}
+
+// rawSeedCacheEntry is the gob-encoded contents of a raw seed cache file.
+// Size/ModTime/Min/Avg/Max together form the cache key: the chunk table is
+// only reusable for a file that hasn't changed, scanned with the exact
+// same chunking parameters that produced it, since those parameters
+// determine where the cut points (and therefore the chunk table) end up.
+type rawSeedCacheEntry struct {
+	Size    int64
+	ModTime int64
+	Min     uint64
+	Avg     uint64
+	Max     uint64
+	Chunks  []IndexChunk
+}
+
+func readRawSeedCache(path string, info os.FileInfo, min, avg, max uint64) ([]IndexChunk, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	var entry rawSeedCacheEntry
+	if err := gob.NewDecoder(f).Decode(&entry); err != nil {
+		return nil, false
+	}
+	if entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		return nil, false
+	}
+	if entry.Min != min || entry.Avg != avg || entry.Max != max {
+		return nil, false
+	}
+	return entry.Chunks, true
+}
+
+// writeRawSeedCache persists the scanned chunk table, along with the
+// parameters it was scanned with, so the next seed from the same file
+// with the same parameters can skip the scan. Failing to write the cache
+// isn't fatal, it just means the next call rescans.
+func writeRawSeedCache(path string, info os.FileInfo, min, avg, max uint64, chunks []IndexChunk) {
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	entry := rawSeedCacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Min:     min,
+		Avg:     avg,
+		Max:     max,
+		Chunks:  chunks,
+	}
+	if err := gob.NewEncoder(f).Encode(entry); err != nil {
+		os.Remove(path)
+	}
+}
+
 // LongestMatchWith returns the longest sequence of of chunks anywhere in Source
 // that match b starting at b[0]. If there is no match, it returns nil
 func (s *FileSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
-	if len(chunks) == 0 || len(s.index.Chunks) == 0 {
+	if len(s.index.Chunks) == 0 {
+		return 0, nil
+	}
+	max, match := longestChunkMatch(s.index.Chunks, s.pos, chunks)
+	if max == 0 {
+		return 0, nil
+	}
+	return max, newFileSeedSegment(s.srcFile, match, s.copyMethods, s.preserveSparse, s.verifyMode, true)
+}
+
+// longestChunkMatch finds, across every position of needle[0] recorded in
+// pos, the longest run of consecutive chunks in haystack that matches the
+// start of needle. It's shared between FileSeed and SelfSeed, which differ
+// only in where haystack and pos come from.
+//
+// A match is only extended from haystack[dp-1] to haystack[dp] while the
+// two are physically contiguous (haystack[dp].Start ==
+// haystack[dp-1].Start+haystack[dp-1].Size): slice adjacency only implies
+// file adjacency when that holds. For FileSeed's index this is always
+// true by construction; for SelfSeed it guards against chunks that happen
+// to sit next to each other in the sorted slice without actually being
+// adjacent on disk (e.g. two regions with a not-yet-written gap between
+// them).
+func longestChunkMatch(haystack []IndexChunk, pos map[ChunkID][]int, needle []IndexChunk) (int, []IndexChunk) {
+	if len(needle) == 0 {
 		return 0, nil
 	}
-	pos, ok := s.pos[chunks[0].ID]
+	positions, ok := pos[needle[0].ID]
 	if !ok {
 		return 0, nil
 	}
-	// From every position of b[0] in the source, find a slice of
-	// matching chunks. Then return the longest of those slices.
 	var (
 		match []IndexChunk
 		max   int
 	)
-	for _, p := range pos {
-		m := s.maxMatchFrom(chunks, p)
-		if len(m) > max {
-			match = m
-			max = len(m)
+	for _, p := range positions {
+		dp, sp := p, 0
+		for dp < len(haystack) && sp < len(needle) && haystack[dp].ID == needle[sp].ID {
+			if dp > p && haystack[dp].Start != haystack[dp-1].Start+haystack[dp-1].Size {
+				break
+			}
+			dp++
+			sp++
+		}
+		if m := dp - p; m > max {
+			max = m
+			match = haystack[p:dp]
 		}
 	}
-	return max, newFileSeedSegment(s.srcFile, match, s.canReflink, true)
+	return max, match
 }
 
-// Returns a slice of chunks from the seed. Compares chunks from position 0
-// with seed chunks starting at p.
-func (s *FileSeed) maxMatchFrom(chunks []IndexChunk, p int) []IndexChunk {
-	if len(chunks) == 0 {
-		return nil
+// SelfSeed treats the file currently being extracted as its own seed: as
+// the extractor writes each chunk to the destination, it calls Add so that
+// later chunks sharing the same ID can be satisfied with an intra-file
+// reflink/copy instead of a fetch from the chunk store. This is a big win
+// for images that internally duplicate large regions, such as VM disk
+// images, container layers or filesystems with many identical files.
+//
+// SelfSeed is safe for concurrent use: Add and LongestMatchWith are called
+// from the same extraction workers that write chunks in parallel, so Add
+// calls can complete out of file-offset order. s.chunks is kept sorted by
+// Start rather than by completion order so slice adjacency always mirrors
+// file adjacency, which is what longestChunkMatch relies on to treat a
+// multi-chunk match as a single contiguous region.
+type SelfSeed struct {
+	file string
+
+	mu     sync.RWMutex
+	chunks []IndexChunk         // sorted by Start
+	pos    map[ChunkID][]uint64 // chunk ID -> Start offsets it was written at
+}
+
+// NewSelfSeed initializes a self-seed for the given extraction target. It
+// starts out empty; chunks only become visible to LongestMatchWith once
+// Add has been called for them.
+func NewSelfSeed(file string) *SelfSeed {
+	return &SelfSeed{
+		file: file,
+		pos:  make(map[ChunkID][]uint64),
 	}
-	var (
-		sp int
-		dp = p
-	)
-	for {
-		if dp >= len(s.index.Chunks) || sp >= len(chunks) {
-			break
-		}
-		if chunks[sp].ID != s.index.Chunks[dp].ID {
-			break
+}
+
+// Add records that chunk id has been written to the destination file at
+// [start, start+size). It must only be called once that write has
+// completed, since LongestMatchWith may use it to satisfy a later chunk
+// immediately. Workers can call Add in any order; the chunk is inserted
+// at its sorted position by Start rather than appended.
+func (s *SelfSeed) Add(id ChunkID, start, size uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.chunks), func(i int) bool { return s.chunks[i].Start >= start })
+	s.chunks = append(s.chunks, IndexChunk{})
+	copy(s.chunks[i+1:], s.chunks[i:len(s.chunks)-1])
+	s.chunks[i] = IndexChunk{ID: id, Start: start, Size: size}
+	s.pos[id] = append(s.pos[id], start)
+}
+
+// LongestMatchWith returns the longest sequence of chunks already written
+// to the destination that match chunks starting at chunks[0]. If there is
+// no match, it returns nil.
+func (s *SelfSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.chunks) == 0 || len(chunks) == 0 {
+		return 0, nil
+	}
+	starts, ok := s.pos[chunks[0].ID]
+	if !ok {
+		return 0, nil
+	}
+	// longestChunkMatch wants indices into s.chunks, not the Start offsets
+	// pos tracks; resolve them via binary search since s.chunks is sorted.
+	idx := make([]int, 0, len(starts))
+	for _, st := range starts {
+		i := sort.Search(len(s.chunks), func(i int) bool { return s.chunks[i].Start >= st })
+		if i < len(s.chunks) && s.chunks[i].Start == st {
+			idx = append(idx, i)
 		}
-		dp++
-		sp++
 	}
-	return s.index.Chunks[p:dp]
+	max, match := longestChunkMatch(s.chunks, map[ChunkID][]int{chunks[0].ID: idx}, chunks)
+	// match aliases s.chunks' backing array. A later Add does an in-place
+	// sorted insert that shifts elements of that same array, which would
+	// silently rewrite the ID/Start/Size of chunks already handed back
+	// here once the caller is done reading this segment. Copy the matched
+	// chunks out before releasing the lock so the segment's data can't be
+	// mutated out from under it.
+	owned := make([]IndexChunk, len(match))
+	copy(owned, match)
+	// Sparse handling isn't wired up for self-seeds yet, since the regions
+	// it clones come from the destination file, not an external seed.
+	// Validation stays on here (unlike most self-seed state, the data
+	// being matched against has already moved between workers) so a stale
+	// or out-of-order entry is caught by the SHA check instead of
+	// silently copying the wrong bytes.
+	return max, newFileSeedSegment(s.file, owned, DefaultCopyRangeMethods, false, VerifyFull, true)
 }
 
 type fileSeedSegment struct {
 	file           string
 	chunks         []IndexChunk
-	canReflink     bool
+	copyMethods    []CopyRangeMethod
+	preserveSparse bool
+	verifyMode     VerifyMode
 	needValidation bool
 }
 
-func newFileSeedSegment(file string, chunks []IndexChunk, canReflink, needValidation bool) *fileSeedSegment {
+func newFileSeedSegment(file string, chunks []IndexChunk, copyMethods []CopyRangeMethod, preserveSparse bool, verifyMode VerifyMode, needValidation bool) *fileSeedSegment {
 	return &fileSeedSegment{
-		canReflink:     canReflink,
+		copyMethods:    copyMethods,
+		preserveSparse: preserveSparse,
+		verifyMode:     verifyMode,
 		needValidation: needValidation,
 		file:           file,
 		chunks:         chunks,
@@ -121,16 +424,49 @@ func (s *fileSeedSegment) WriteInto(dst *os.File, offset, length, blocksize uint
 		}
 	}
 
-	// Do a straight copy if reflinks are not supported
-	if !s.canReflink {
-		return s.copy(dst, src, s.chunks[0].Start, length, offset)
+	if !s.preserveSparse {
+		return s.copyRange(dst, src, s.chunks[0].Start, length, offset, blocksize)
 	}
-	return s.clone(dst, src, s.chunks[0].Start, length, offset, blocksize)
+	return s.writeSparse(dst, src, offset, blocksize)
 }
 
-// Compares all chunks in this slice of the seed index to the underlying data
-// and fails if they don't match.
+// copyRange tries each of this segment's CopyRangeMethods in turn, falling
+// through to the next one whenever a method reports it can't handle this
+// particular fd/alignment/filesystem combination.
+func (s *fileSeedSegment) copyRange(dst, src *os.File, srcOffset, length, dstOffset, blocksize uint64) error {
+	var lastErr error
+	for _, m := range s.copyMethods {
+		err := m.CopyRange(dst, src, srcOffset, length, dstOffset, blocksize)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrCopyRangeUnsupported) {
+			return err
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = ErrCopyRangeUnsupported
+	}
+	return fmt.Errorf("no usable copy-range method from %s to %s: %w", src.Name(), dst.Name(), lastErr)
+}
+
+// validate checks this slice of the seed index against the underlying
+// data, the way required by s.verifyMode.
 func (s *fileSeedSegment) validate(src *os.File) error {
+	switch s.verifyMode {
+	case VerifyNone:
+		return nil
+	case VerifyCRC:
+		return s.validateCRC(src)
+	default:
+		return s.validateFull(src)
+	}
+}
+
+// validateFull compares all chunks in this slice of the seed index to the
+// underlying data by re-hashing them and fails if they don't match.
+func (s *fileSeedSegment) validateFull(src *os.File) error {
 	for _, c := range s.chunks {
 		b := make([]byte, c.Size)
 		if _, err := src.ReadAt(b, int64(c.Start)); err != nil {
@@ -144,40 +480,28 @@ func (s *fileSeedSegment) validate(src *os.File) error {
 	return nil
 }
 
-// Performs a plain copy of everything in the seed to the target, not cloning
-// of blocks.
-func (s *fileSeedSegment) copy(dst, src *os.File, srcOffset, srcLength, dstOffset uint64) error {
-	if _, err := dst.Seek(int64(dstOffset), os.SEEK_SET); err != nil {
-		return err
-	}
-	if _, err := src.Seek(int64(srcOffset), os.SEEK_SET); err != nil {
-		return err
-	}
-	_, err := io.CopyN(dst, src, int64(srcLength))
-	return err
-}
-
-// Reflink the overlapping blocks in the two ranges and copy the bit before and
-// after the blocks.
-func (s *fileSeedSegment) clone(dst, src *os.File, srcOffset, srcLength, dstOffset, blocksize uint64) error {
-	if srcOffset%blocksize != dstOffset%blocksize {
-		return fmt.Errorf("reflink ranges not aligned between %s and %s", src.Name(), dst.Name())
-	}
-
-	srcAlignStart := (srcOffset/blocksize + 1) * blocksize
-	srcAlignEnd := (srcOffset + srcLength) / blocksize * blocksize
-	dstAlignStart := (dstOffset/blocksize + 1) * blocksize
-	alignLength := srcAlignEnd - srcAlignStart
-	dstAlignEnd := dstAlignStart + alignLength
-
-	// fill the area before the first aligned block
-	if err := s.copy(dst, src, srcOffset, srcAlignStart-srcOffset, dstOffset); err != nil {
-		return err
+// validateCRC checks this slice of the seed index against the file's
+// CRC32C sidecar, which is far cheaper than re-hashing with SHA-512/256.
+// It falls back to validateFull whenever the sidecar is missing, doesn't
+// cover a chunk, or reports a mismatch, so a CRC miss never silently
+// passes a seed through unverified.
+func (s *fileSeedSegment) validateCRC(src *os.File) error {
+	records, err := readCRCSidecar(crcSidecarPath(s.file))
+	if err != nil {
+		return s.validateFull(src)
 	}
-	// fill the area after the last aligned block
-	if err := s.copy(dst, src, srcAlignEnd, srcOffset+srcLength-srcAlignEnd, dstAlignEnd); err != nil {
-		return err
+	for _, c := range s.chunks {
+		rec, ok := findCRCRecord(records, c.Start)
+		if !ok || rec.Length != c.Size {
+			return s.validateFull(src)
+		}
+		b := make([]byte, c.Size)
+		if _, err := src.ReadAt(b, int64(c.Start)); err != nil {
+			return err
+		}
+		if crc32.Checksum(b, crc32cTable) != rec.CRC {
+			return s.validateFull(src)
+		}
 	}
-	// close the aligned blocks
-	return CloneRange(dst, src, srcAlignStart, alignLength, dstAlignStart)
+	return nil
 }
@@ -0,0 +1,106 @@
+package desync
+
+import "testing"
+
+func chunkID(b byte) ChunkID {
+	var id ChunkID
+	id[0] = b
+	return id
+}
+
+func TestLongestChunkMatchStopsAtGap(t *testing.T) {
+	// chunk 0 and 1 are physically contiguous, but chunk 2 isn't (there's
+	// a gap between it and chunk 1), even though it sits right after it
+	// in the slice.
+	haystack := []IndexChunk{
+		{ID: chunkID(1), Start: 0, Size: 10},
+		{ID: chunkID(2), Start: 10, Size: 10},
+		{ID: chunkID(3), Start: 30, Size: 10}, // gap: should be at Start 20
+	}
+	pos := map[ChunkID][]int{chunkID(1): {0}}
+	needle := []IndexChunk{
+		{ID: chunkID(1)},
+		{ID: chunkID(2)},
+		{ID: chunkID(3)},
+	}
+
+	max, match := longestChunkMatch(haystack, pos, needle)
+	if max != 2 {
+		t.Fatalf("expected match to stop before the gap (max=2), got max=%d", max)
+	}
+	if len(match) != 2 || match[0].ID != chunkID(1) || match[1].ID != chunkID(2) {
+		t.Fatalf("unexpected match contents: %+v", match)
+	}
+}
+
+func TestSelfSeedOutOfOrderAdd(t *testing.T) {
+	s := NewSelfSeed("/dev/null")
+
+	// Simulate concurrent workers completing writes out of file-offset
+	// order: chunk at offset 10 finishes before the one at offset 0.
+	s.Add(chunkID(2), 10, 10)
+	s.Add(chunkID(1), 0, 10)
+	s.Add(chunkID(3), 20, 10)
+
+	if len(s.chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(s.chunks))
+	}
+	for i := 1; i < len(s.chunks); i++ {
+		if s.chunks[i].Start < s.chunks[i-1].Start {
+			t.Fatalf("chunks not sorted by Start: %+v", s.chunks)
+		}
+	}
+
+	needle := []IndexChunk{
+		{ID: chunkID(1)},
+		{ID: chunkID(2)},
+		{ID: chunkID(3)},
+	}
+	max, seg := s.LongestMatchWith(needle)
+	if max != 3 {
+		t.Fatalf("expected all 3 chunks to match despite out-of-order Add, got max=%d", max)
+	}
+	fss, ok := seg.(*fileSeedSegment)
+	if !ok {
+		t.Fatalf("expected *fileSeedSegment, got %T", seg)
+	}
+	if fss.Size() != 30 {
+		t.Fatalf("expected a contiguous 30-byte segment, got %d", fss.Size())
+	}
+	if !fss.needValidation {
+		t.Fatalf("expected self-seed segments to still be validated")
+	}
+}
+
+// TestSelfSeedAddDoesNotMutateReturnedSegment guards against a sorted
+// insertion in Add reaching into the backing array of a slice already
+// handed back by a prior LongestMatchWith call.
+func TestSelfSeedAddDoesNotMutateReturnedSegment(t *testing.T) {
+	s := NewSelfSeed("/dev/null")
+	s.Add(chunkID(1), 0, 10)
+	s.Add(chunkID(2), 10, 10)
+	s.Add(chunkID(3), 20, 10)
+
+	needle := []IndexChunk{
+		{ID: chunkID(1)},
+		{ID: chunkID(2)},
+		{ID: chunkID(3)},
+	}
+	max, seg := s.LongestMatchWith(needle)
+	if max != 3 {
+		t.Fatalf("expected all 3 chunks to match, got max=%d", max)
+	}
+	fss := seg.(*fileSeedSegment)
+	wantFirst := fss.chunks[0]
+
+	// A concurrent Add landing at or before the start of the already
+	// matched region must not alter the chunks already returned above.
+	s.Add(chunkID(4), 0, 1)
+
+	if fss.chunks[0] != wantFirst {
+		t.Fatalf("returned segment was mutated by a later Add: got %+v, want %+v", fss.chunks[0], wantFirst)
+	}
+	if fss.Size() != 30 {
+		t.Fatalf("returned segment's size changed after a later Add: got %d, want 30", fss.Size())
+	}
+}
@@ -0,0 +1,46 @@
+package desync
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRawSeedCacheInvalidatesOnChunkingParams(t *testing.T) {
+	f, err := os.CreateTemp("", "desync-rawseed-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("some seed content"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := rawSeedCachePath(f.Name())
+	defer os.Remove(cache)
+
+	want := []IndexChunk{{ID: chunkID(1), Start: 0, Size: 17}}
+	writeRawSeedCache(cache, info, 100, 200, 300, want)
+
+	got, ok := readRawSeedCache(cache, info, 100, 200, 300)
+	if !ok {
+		t.Fatal("expected cache hit for matching size/mtime/min/avg/max")
+	}
+	if len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("unexpected cached chunks: %+v", got)
+	}
+
+	if _, ok := readRawSeedCache(cache, info, 100, 200, 301); ok {
+		t.Fatal("expected cache miss when max chunk size differs from what the cache was built with")
+	}
+	if _, ok := readRawSeedCache(cache, info, 100, 201, 300); ok {
+		t.Fatal("expected cache miss when avg chunk size differs from what the cache was built with")
+	}
+	if _, ok := readRawSeedCache(cache, info, 101, 200, 300); ok {
+		t.Fatal("expected cache miss when min chunk size differs from what the cache was built with")
+	}
+}
@@ -0,0 +1,135 @@
+package desync
+
+import (
+	"crypto/sha512"
+	"os"
+	"sync"
+)
+
+// zeroChunkIDs memoizes the chunk ID of an all-zero chunk per size, since
+// desync's content-defined chunker produces only a handful of distinct
+// chunk sizes in practice and recomputing the hash for every zero chunk
+// would defeat the point of detecting them cheaply.
+var zeroChunkIDs sync.Map // size uint64 -> ChunkID
+
+// zeroChunkID returns the chunk ID that `size` zero bytes would hash to.
+func zeroChunkID(size uint64) ChunkID {
+	if id, ok := zeroChunkIDs.Load(size); ok {
+		return id.(ChunkID)
+	}
+	id := ChunkID(sha512.Sum512_256(make([]byte, size)))
+	zeroChunkIDs.Store(size, id)
+	return id
+}
+
+// isZeroChunk reports whether c's recorded ID matches what its size of
+// zero bytes would hash to, without having to read and compare the data.
+func isZeroChunk(c IndexChunk) bool {
+	return c.ID == zeroChunkID(c.Size)
+}
+
+// writeSparse writes this segment into dst the way WriteInto normally
+// does, except runs of all-zero chunks are turned into holes
+// (FALLOC_FL_PUNCH_HOLE) rather than physically written, and holes already
+// present in the seed file are skipped via SEEK_HOLE/SEEK_DATA rather than
+// read and copied.
+func (s *fileSeedSegment) writeSparse(dst, src *os.File, offset, blocksize uint64) error {
+	base := s.chunks[0].Start
+	for i := 0; i < len(s.chunks); {
+		zero := isZeroChunk(s.chunks[i])
+		j := i + 1
+		for j < len(s.chunks) && isZeroChunk(s.chunks[j]) == zero {
+			j++
+		}
+		runStart := s.chunks[i].Start
+		runEnd := s.chunks[j-1].Start + s.chunks[j-1].Size
+		dstOffset := offset + (runStart - base)
+
+		var err error
+		if zero {
+			err = s.punchOrZero(dst, dstOffset, runEnd-runStart)
+		} else {
+			err = s.copySparseRange(dst, src, runStart, runEnd-runStart, dstOffset, blocksize)
+		}
+		if err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// copySparseRange copies [srcOffset, srcOffset+length) from src to dst,
+// skipping holes already in src and turning them into holes in dst rather
+// than reading and re-writing their zeroes.
+func (s *fileSeedSegment) copySparseRange(dst, src *os.File, srcOffset, length, dstOffset, blocksize uint64) error {
+	end := int64(srcOffset + length)
+	pos := int64(srcOffset)
+	for pos < end {
+		dataStart, err := seekDataOrEnd(src, pos, end)
+		if err != nil {
+			return err
+		}
+		if dataStart > pos {
+			holeLen := uint64(dataStart - pos)
+			if err := s.punchOrZero(dst, dstOffset+uint64(pos-int64(srcOffset)), holeLen); err != nil {
+				return err
+			}
+			pos = dataStart
+			continue
+		}
+		holeStart, err := seekHoleOrEnd(src, pos, end)
+		if err != nil {
+			return err
+		}
+		dataLen := uint64(holeStart - pos)
+		if err := s.copyRange(dst, src, uint64(pos), dataLen, dstOffset+uint64(pos-int64(srcOffset)), blocksize); err != nil {
+			return err
+		}
+		pos = holeStart
+	}
+	return nil
+}
+
+// punchOrZero tries to turn [offset, offset+length) in dst into a hole,
+// falling back to physically writing zero bytes when the destination
+// filesystem doesn't support punching holes.
+func (s *fileSeedSegment) punchOrZero(dst *os.File, offset, length uint64) error {
+	if length == 0 {
+		return nil
+	}
+	ok, err := punchHole(dst, offset, length)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	return writeZeroes(dst, offset, length)
+}
+
+// zeroWriteBufSize is the buffer size used to physically write zeroes when
+// hole punching isn't available.
+const zeroWriteBufSize = 1 << 20
+
+func writeZeroes(dst *os.File, offset, length uint64) error {
+	if _, err := dst.Seek(int64(offset), os.SEEK_SET); err != nil {
+		return err
+	}
+	bufSize := uint64(zeroWriteBufSize)
+	if length < bufSize {
+		bufSize = length
+	}
+	buf := make([]byte, bufSize)
+	for length > 0 {
+		n := bufSize
+		if length < n {
+			n = length
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return err
+		}
+		length -= n
+	}
+	return nil
+}
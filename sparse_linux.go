@@ -0,0 +1,54 @@
+//go:build linux
+
+package desync
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// punchHole turns [offset, offset+length) in f into an unallocated hole via
+// fallocate(FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE). It reports false,
+// rather than an error, when the underlying filesystem doesn't support
+// punching holes, so the caller can fall back to writing real zeroes.
+func punchHole(f *os.File, offset, length uint64) (bool, error) {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, int64(offset), int64(length))
+	if err == nil {
+		return true, nil
+	}
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return false, nil
+	}
+	return false, err
+}
+
+// seekDataOrEnd returns the offset of the next data region in f at or
+// after offset, or end if there's only a hole between offset and end.
+func seekDataOrEnd(f *os.File, offset, end int64) (int64, error) {
+	pos, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_DATA)
+	if err != nil {
+		if err == unix.ENXIO {
+			// No more data after offset: everything to EOF is a hole.
+			return end, nil
+		}
+		return 0, err
+	}
+	if pos > end {
+		pos = end
+	}
+	return pos, nil
+}
+
+// seekHoleOrEnd returns the offset of the next hole in f at or after
+// offset, or end if there's only data between offset and end.
+func seekHoleOrEnd(f *os.File, offset, end int64) (int64, error) {
+	pos, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_HOLE)
+	if err != nil {
+		return 0, err
+	}
+	if pos > end {
+		pos = end
+	}
+	return pos, nil
+}
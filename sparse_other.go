@@ -0,0 +1,23 @@
+//go:build !linux
+
+package desync
+
+import "os"
+
+// punchHole is unavailable on this platform; PreserveSparse falls back to
+// physically writing zeroes for any chunk it would otherwise have punched.
+func punchHole(f *os.File, offset, length uint64) (bool, error) {
+	return false, nil
+}
+
+// seekDataOrEnd treats the whole range as data on platforms without
+// SEEK_DATA support.
+func seekDataOrEnd(f *os.File, offset, end int64) (int64, error) {
+	return offset, nil
+}
+
+// seekHoleOrEnd treats the whole range as data on platforms without
+// SEEK_HOLE support, so the caller copies it in one go.
+func seekHoleOrEnd(f *os.File, offset, end int64) (int64, error) {
+	return end, nil
+}